@@ -2,37 +2,63 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log/slog"
+	"math/big"
 	"net"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fatih/color"
 )
 
 type Config struct {
-	BaseURL     string
-	Wordlist    string        // Wordlist Path
-	Threads     int           // Number of concurrent threads - default is 10
-	Timeout     time.Duration // Request timeout
-	Port        int           // Port to use for Gemini requests
-	Extensions  []string      // Comma-separated list of extensions to append to each word
-	Recursive   int           // Level of recursion on directory hit
-	Spider      bool          // Spider links on page. Default = true
-	Insecure    bool          // Allow self-signed TLS connections
-	Verbose     bool          // Verb logging
-	Debug       bool          // Debug logging
-	FilterCodes []string      // whitelisted gemini status codes
-	FilterSize  int           // whitelisted gemini status codes
-	Mode        string        // Fuzzing mode: subdir, subdomain, query
+	BaseURL      string
+	Wordlist     string        // Wordlist Path
+	Threads      int           // Number of concurrent threads - default is 10
+	Timeout      time.Duration // Request timeout
+	Port         int           // Port to use for Gemini requests
+	Extensions   []string      // Comma-separated list of extensions to append to each word
+	Recursive    int           // Level of recursion on directory hit
+	Spider       bool          // Spider links on page. Default = true
+	Insecure     bool          // Bypass TOFU certificate pinning
+	Verbose      bool          // Verb logging
+	Debug        bool          // Debug logging
+	FilterCodes  []string      // whitelisted gemini status codes
+	FilterSize   int           // Filter out responses of this size in bytes; -1 filters none
+	Mode         string        // Fuzzing mode: subdir, subdomain, query
+	Tofu         bool          // Enable trust-on-first-use certificate pinning
+	TofuFile     string        // Path to the TOFU known_hosts store
+	CertFile     string        // PEM client certificate for identity auth
+	KeyFile      string        // PEM client key for identity auth
+	Transient    bool          // Generate an ephemeral client cert per run
+	TransientCN  string        // CommonName for the transient client cert
+	OutputFile   string        // Destination file for results; empty means stdout
+	OutputFormat string        // pretty, jsonl, csv, or plain
+	OutputAll    bool          // Emit every attempt, not just whitelisted hits
+	Rate         float64       // Max requests/sec per host; 0 = unlimited
+	MaxRetries   int           // Max requeues for a 44 SLOW_DOWN'd job
+	NoWildcard   bool          // Disable wildcard/soft-404 baseline detection
+	BaselineN    int           // Number of random-path probes for wildcard detection
 }
 
 func parseConfig() (*Config, error) {
@@ -60,10 +86,23 @@ func parseConfig() (*Config, error) {
 	fs.IntVar(&cfg.Port, "p", 1965, "Port to use for Gemini requests")
 	fs.IntVar(&cfg.FilterSize, "s", -1, "Filter out requests of a given size (in bytes)")
 	fs.BoolVar(&cfg.Spider, "spider", true, "Spider links on page")
-	fs.BoolVar(&cfg.Insecure, "k", true, "Allow insecure TLS connections")
+	fs.BoolVar(&cfg.Insecure, "k", false, "Allow insecure TLS connections, bypassing TOFU pinning")
 	fs.StringVar(&FilterCodes, "c", "2,3", "Comma-separated whitelisted status codes (supports wildcards)")
 	fs.BoolVar(&cfg.Verbose, "v", false, "Enable verbose logging")
 	fs.BoolVar(&cfg.Debug, "d", false, "Enable debug logging")
+	fs.BoolVar(&cfg.Tofu, "tofu", true, "Enable trust-on-first-use certificate pinning")
+	fs.StringVar(&cfg.TofuFile, "tofu-file", "", "Path to TOFU known_hosts store (default ~/.config/gembuster/known_hosts)")
+	fs.StringVar(&cfg.CertFile, "cert", "", "PEM client certificate to present for identity-gated paths")
+	fs.StringVar(&cfg.KeyFile, "key", "", "PEM private key matching -cert")
+	fs.BoolVar(&cfg.Transient, "transient-cert", false, "Generate an ephemeral client certificate for this run")
+	fs.StringVar(&cfg.TransientCN, "transient-cert-cn", "gembuster", "CommonName to use for -transient-cert")
+	fs.StringVar(&cfg.OutputFile, "o", "", "Write results to this file instead of stdout")
+	fs.StringVar(&cfg.OutputFormat, "of", "pretty", "Output format: pretty, jsonl, csv, plain")
+	fs.BoolVar(&cfg.OutputAll, "output-all", false, "Emit every attempt, not just whitelisted hits")
+	fs.Float64Var(&cfg.Rate, "rate", 0, "Max requests/sec per host (0 = unlimited)")
+	fs.IntVar(&cfg.MaxRetries, "max-retries", 5, "Max requeues for a 44 SLOW_DOWN response before dropping the job")
+	fs.BoolVar(&cfg.NoWildcard, "no-wildcard", false, "Disable wildcard/soft-404 baseline detection")
+	fs.IntVar(&cfg.BaselineN, "baseline-probes", 3, "Number of random-path probes used to detect wildcard responses")
 
 	// Custom usage showing positional mode
 	fs.Usage = func() {
@@ -96,6 +135,12 @@ func parseConfig() (*Config, error) {
 	if timeoutSec <= 0 {
 		return nil, fmt.Errorf("timeout must be > 0")
 	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, fmt.Errorf("-cert and -key must be provided together")
+	}
+	if cfg.Transient && cfg.CertFile != "" {
+		return nil, fmt.Errorf("-transient-cert and -cert are mutually exclusive")
+	}
 	cfg.Timeout = time.Duration(timeoutSec) * time.Second
 	cfg.FilterCodes = strings.Split(FilterCodes, ",")
 
@@ -104,6 +149,12 @@ func parseConfig() (*Config, error) {
 		cfg.BaseURL = "gemini://" + cfg.BaseURL
 	}
 
+	if cfg.TofuFile == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			cfg.TofuFile = filepath.Join(home, ".config", "gembuster", "known_hosts")
+		}
+	}
+
 	var level slog.LevelVar
 	level.Set(slog.LevelWarn)
 
@@ -139,36 +190,201 @@ func parseWordlist(path string) ([]string, error) {
 	return wordlist, nil
 }
 
-func fetchGeminiOnce(rawURL string, baseURL *url.URL, timeout time.Duration, insecure bool) (status string, meta string, size int64, err error) {
+// TofuError reports a trust-on-first-use certificate mismatch for a host.
+type TofuError struct {
+	Host string
+	Err  error
+}
+
+func (e *TofuError) Error() string { return fmt.Sprintf("TOFU failure for %s: %v", e.Host, e.Err) }
+func (e *TofuError) Unwrap() error { return e.Err }
+
+// tofuEntry is a single pinned certificate: its fingerprint and expiry, so
+// an expired pin can be silently replaced on next use.
+type tofuEntry struct {
+	hash     string
+	notAfter time.Time
+}
+
+// TofuStore implements trust-on-first-use certificate pinning, mirroring the
+// known_hosts semantics of clients like Bombadillo: the first certificate
+// seen for a host is pinned, mismatches are rejected unless the pinned
+// certificate has already expired, in which case it is replaced.
+type TofuStore struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]tofuEntry
+}
+
+// NewTofuStore loads a TOFU store from path, creating an empty one if the
+// file does not yet exist.
+func NewTofuStore(path string) (*TofuStore, error) {
+	s := &TofuStore{path: path, entries: make(map[string]tofuEntry)}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		notAfter, err := time.Parse(time.RFC3339, fields[2])
+		if err != nil {
+			continue
+		}
+		s.entries[fields[0]] = tofuEntry{hash: fields[1], notAfter: notAfter}
+	}
+	return s, scanner.Err()
+}
+
+// save persists the store as "host hash expiry" lines.
+func (s *TofuStore) save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	var b strings.Builder
+	for host, e := range s.entries {
+		fmt.Fprintf(&b, "%s %s %s\n", host, e.hash, e.notAfter.Format(time.RFC3339))
+	}
+	return os.WriteFile(s.path, []byte(b.String()), 0o600)
+}
+
+// Verify checks cert against the pin on file for host, adding or replacing
+// it as needed, and returns a *TofuError on mismatch.
+func (s *TofuStore) Verify(host string, cert *x509.Certificate) error {
+	sum := sha256.Sum256(cert.Raw)
+	hash := hex.EncodeToString(sum[:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, known := s.entries[host]
+	switch {
+	case !known:
+		s.entries[host] = tofuEntry{hash: hash, notAfter: cert.NotAfter}
+		return s.save()
+	case existing.hash == hash:
+		return nil
+	case time.Now().After(existing.notAfter):
+		slog.Info("TOFU pin expired, replacing", "host", host)
+		s.entries[host] = tofuEntry{hash: hash, notAfter: cert.NotAfter}
+		return s.save()
+	default:
+		return &TofuError{Host: host, Err: fmt.Errorf("certificate changed: pinned %s (expires %s), got %s", existing.hash, existing.notAfter.Format(time.RFC3339), hash)}
+	}
+}
+
+// loadIdentity resolves the client certificate (if any) to present for
+// identity-gated Gemini paths, per -cert/-key or -transient-cert.
+func loadIdentity(cfg *Config) (*tls.Certificate, error) {
+	if cfg.Transient {
+		return generateTransientCert(cfg.TransientCN)
+	}
+	if cfg.CertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading client cert/key: %w", err)
+	}
+	return &cert, nil
+}
+
+// generateTransientCert creates an ephemeral, self-signed ed25519 client
+// certificate for a single run, for probing identity-gated paths without
+// leaving a long-lived credential behind.
+func generateTransientCert(cn string) (*tls.Certificate, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, priv)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}, nil
+}
+
+func fetchGeminiOnce(rawURL string, baseURL *url.URL, cfg *Config, tofu *TofuStore, identity *tls.Certificate) (status string, meta string, size int64, body []byte, tlsFingerprint string, bodyHash string, err error) {
 
 	slog.Debug("Fetching URL", "url", rawURL)
 
 	u, err := url.Parse(rawURL)
 	if err != nil {
-		return "", "", 0, err
+		return "", "", 0, nil, "", "", err
 	}
 
-	dialer := &net.Dialer{Timeout: timeout}
-	conn, err := tls.DialWithDialer(dialer, "tcp", baseURL.Host, &tls.Config{
+	tlsConfig := &tls.Config{
 		ServerName:         u.Hostname(),
-		InsecureSkipVerify: insecure,
-	})
+		InsecureSkipVerify: true,
+	}
+
+	if identity != nil {
+		tlsConfig.Certificates = []tls.Certificate{*identity}
+	}
+
+	if !cfg.Insecure && tofu != nil {
+		host := u.Hostname()
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("no certificate presented by %s", host)
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return fmt.Errorf("parsing leaf certificate for %s: %w", host, err)
+			}
+			return tofu.Verify(host, cert)
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", baseURL.Host, tlsConfig)
 
 	if err != nil {
 		fmt.Printf("%s\n", err)
-		return "", "", 0, err
+		return "", "", 0, nil, "", "", err
 	}
 	defer conn.Close()
 
+	if peerCerts := conn.ConnectionState().PeerCertificates; len(peerCerts) > 0 {
+		sum := sha256.Sum256(peerCerts[0].Raw)
+		tlsFingerprint = hex.EncodeToString(sum[:])
+	}
+
 	if _, err := conn.Write([]byte(rawURL + "\r\n")); err != nil {
-		return "", "", 0, err
+		return "", "", 0, nil, tlsFingerprint, "", err
 	}
 
 	// Read in response header
 	r := bufio.NewReader(conn)
 	header, err := r.ReadString('\n')
 	if err != nil {
-		return "", "", 0, err
+		return "", "", 0, nil, tlsFingerprint, "", err
 	}
 
 	header = strings.TrimRight(header, "\r\n")
@@ -182,13 +398,39 @@ func fetchGeminiOnce(rawURL string, baseURL *url.URL, timeout time.Duration, ins
 		meta = parts[1]
 	}
 
-	// TODO: Add filtering based on body content
-
-	n, err := io.Copy(io.Discard, r) // Discard body
+	// Only text/gemini bodies are ever worth keeping around (link extraction);
+	// everything else is hashed (for wildcard detection) and discarded.
+	keepFull := strings.HasPrefix(status, "2") && strings.HasPrefix(meta, "text/gemini")
+	n, buf, bodyHash, err := readBodyWithHash(r, keepFull)
 	if err != nil {
-		return status, meta, n, err
+		return status, meta, n, buf, tlsFingerprint, bodyHash, err
 	}
-	return status, meta, n, nil
+	return status, meta, n, buf, tlsFingerprint, bodyHash, nil
+}
+
+// readBodyWithHash drains r, hashing the first 256 bytes (the portion two
+// synthesized "not found" bodies are near-certain to share) and optionally
+// keeping the full body around for link extraction.
+func readBodyWithHash(r io.Reader, keepFull bool) (size int64, body []byte, hash string, err error) {
+	const hashLen = 256
+
+	prefix := make([]byte, hashLen)
+	n, err := io.ReadFull(r, prefix)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return 0, nil, "", err
+	}
+	prefix = prefix[:n]
+	sum := sha256.Sum256(prefix)
+	hash = hex.EncodeToString(sum[:])
+
+	if keepFull {
+		rest, err := io.ReadAll(r)
+		full := append(prefix, rest...)
+		return int64(len(full)), full, hash, err
+	}
+
+	restN, err := io.Copy(io.Discard, r)
+	return int64(n) + restN, nil, hash, err
 }
 
 func isWhitelisted(status string, codes []string) bool {
@@ -257,6 +499,10 @@ func formatStatusCode(code string) func(string, ...interface{}) string {
 
 	var formatted func(string, ...interface{}) string
 
+	if code == "" {
+		return color.WhiteString
+	}
+
 	switch code[0] {
 	case '1':
 		formatted = color.BlueString
@@ -290,8 +536,444 @@ func formatOutput(u *url.URL, mode string) string {
 }
 
 type Job struct {
-	URL   string
-	Depth int
+	URL     string
+	Depth   int
+	Retries int // number of times this job has been requeued after a 44 SLOW_DOWN
+}
+
+// jobQueue is an unbounded FIFO queue of Jobs. Workers are both the
+// consumers and, via recursion/spider fan-out and 44-retry requeues, the
+// producers pushing back into the same queue, so a fixed-size buffered
+// channel can deadlock once in-flight jobs exceed its capacity while every
+// worker is blocked mid-send. Push never blocks, which removes that case.
+type jobQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	items  []Job
+	closed bool
+}
+
+func newJobQueue() *jobQueue {
+	q := &jobQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Push enqueues j and wakes one waiting consumer.
+func (q *jobQueue) Push(j Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append(q.items, j)
+	q.cond.Signal()
+}
+
+// Pop blocks until a job is available or the queue is closed, returning
+// ok=false once closed and drained.
+func (q *jobQueue) Pop() (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.items) == 0 {
+		return Job{}, false
+	}
+	j := q.items[0]
+	q.items = q.items[1:]
+	return j, true
+}
+
+// Close marks the queue closed, waking all consumers still waiting in Pop.
+func (q *jobQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// hostLimiter throttles requests to a single host and honors Gemini's 44
+// SLOW_DOWN status by shrinking its rate and imposing a cooldown.
+type hostLimiter struct {
+	mu        sync.Mutex
+	interval  time.Duration // minimum gap between requests; 0 means unlimited
+	notBefore time.Time
+	last      time.Time
+}
+
+func newHostLimiter(ratePerSec float64) *hostLimiter {
+	var interval time.Duration
+	if ratePerSec > 0 {
+		interval = time.Duration(float64(time.Second) / ratePerSec)
+	}
+	return &hostLimiter{interval: interval}
+}
+
+// Wait blocks until the limiter allows another request to this host.
+func (l *hostLimiter) Wait() {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		var wait time.Duration
+		if now.Before(l.notBefore) {
+			wait = l.notBefore.Sub(now)
+		} else if l.interval > 0 {
+			if next := l.last.Add(l.interval); next.After(now) {
+				wait = next.Sub(now)
+			}
+		}
+		if wait == 0 {
+			l.last = now
+		}
+		l.mu.Unlock()
+
+		if wait == 0 {
+			return
+		}
+		time.Sleep(wait)
+	}
+}
+
+// SlowDown reacts to a 44 response: it imposes a cooldown of the requested
+// number of seconds and halves the allowed rate (an unlimited host drops to
+// one request per second) so the host isn't hammered again the moment the
+// cooldown passes.
+func (l *hostLimiter) SlowDown(seconds int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if seconds > 0 {
+		if notBefore := time.Now().Add(time.Duration(seconds) * time.Second); notBefore.After(l.notBefore) {
+			l.notBefore = notBefore
+		}
+	}
+	if l.interval == 0 {
+		l.interval = time.Second
+	} else {
+		l.interval *= 2
+	}
+}
+
+// limiterRegistry hands out a shared hostLimiter per host so concurrent
+// workers throttle against the same state.
+type limiterRegistry struct {
+	mu       sync.Mutex
+	rate     float64
+	limiters map[string]*hostLimiter
+}
+
+func newLimiterRegistry(rate float64) *limiterRegistry {
+	return &limiterRegistry{rate: rate, limiters: make(map[string]*hostLimiter)}
+}
+
+func (r *limiterRegistry) forHost(host string) *hostLimiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l, ok := r.limiters[host]
+	if !ok {
+		l = newHostLimiter(r.rate)
+		r.limiters[host] = l
+	}
+	return l
+}
+
+// Baseline is the fingerprint of a synthesized "not found" response,
+// derived by probing a handful of guaranteed-random paths before the scan
+// starts. A worker hit matching it is treated as a wildcard/soft-404
+// rather than a real path, mirroring gobuster's wildcard defense.
+type Baseline struct {
+	Status string
+	Size   int64
+	Hash   string
+}
+
+// Matches reports whether a result's (status, size, body hash) tuple looks
+// like the wildcard response.
+func (b *Baseline) Matches(status string, size int64, hash string) bool {
+	return b.Status == status && b.Size == size && b.Hash == hash
+}
+
+// randomToken returns a UUID-style random path segment, near-certain not to
+// exist on the target capsule.
+func randomToken() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// probeBaseline issues n requests for random, near-certainly-unmapped
+// targets (generated the same way the scan's own jobs are, via gen) and
+// returns the wildcard signature if at least two agree.
+func probeBaseline(baseURL *url.URL, cfg *Config, tofu *TofuStore, gen URLGen, n int) *Baseline {
+	counts := make(map[Baseline]int)
+	for i := 0; i < n; i++ {
+		u := gen(baseURL, randomToken())
+		status, _, size, _, _, hash, err := fetchGeminiOnce(u.String(), baseURL, cfg, tofu, nil)
+		if err != nil {
+			slog.Debug("Baseline probe failed", "url", u, "err", err)
+			continue
+		}
+		counts[Baseline{Status: status, Size: size, Hash: hash}]++
+	}
+
+	for b, count := range counts {
+		if count >= 2 {
+			b := b
+			return &b
+		}
+	}
+	return nil
+}
+
+// Result is one scan attempt, built by the worker and handed to an Output.
+type Result struct {
+	URL            string
+	Status         string
+	Meta           string
+	Size           int64
+	Depth          int
+	RedirectTarget string
+	ElapsedMs      int64
+	TLSFingerprint string
+	AuthRetryOf    string // non-empty initial status if this is a post-6x identity retry
+	Wildcard       bool   // true if this hit matched the wildcard/soft-404 baseline
+}
+
+// Output is a destination for scan results, so the worker doesn't have to
+// know whether it's writing colored terminal rows or machine-readable
+// records.
+type Output interface {
+	Emit(Result)
+	Close() error
+}
+
+// newOutput builds the Output selected by cfg.OutputFormat, writing to
+// cfg.OutputFile if set and stdout otherwise.
+func newOutput(cfg *Config) (Output, error) {
+	var w io.Writer = os.Stdout
+	var c io.Closer
+
+	if cfg.OutputFile != "" {
+		f, err := os.Create(cfg.OutputFile)
+		if err != nil {
+			return nil, fmt.Errorf("creating output file: %w", err)
+		}
+		w, c = f, f
+	}
+
+	switch strings.ToLower(cfg.OutputFormat) {
+	case "", "pretty":
+		return &prettyOutput{w: w, c: c, mode: cfg.Mode, bold: color.New(color.Bold).SprintFunc()}, nil
+	case "jsonl":
+		return &jsonlOutput{w: w, c: c}, nil
+	case "csv":
+		return &csvOutput{w: csv.NewWriter(w), c: c}, nil
+	case "plain":
+		return &plainOutput{w: w, c: c, mode: cfg.Mode}, nil
+	default:
+		return nil, fmt.Errorf("unsupported output format: %s", cfg.OutputFormat)
+	}
+}
+
+// prettyOutput reproduces the original hand-formatted colored row.
+type prettyOutput struct {
+	mu   sync.Mutex
+	w    io.Writer
+	c    io.Closer
+	mode string
+	bold func(...interface{}) string
+}
+
+func (o *prettyOutput) Emit(r Result) {
+	u, _ := url.Parse(r.URL)
+	outputURL := formatOutput(u, o.mode)
+	if r.RedirectTarget != "" {
+		redirURL, _ := url.Parse(r.RedirectTarget)
+		outputURL = fmt.Sprintf("%s -> %s", formatOutput(u, o.mode), formatOutput(redirURL, o.mode))
+	}
+
+	meta := r.Meta
+	if r.AuthRetryOf != "" {
+		meta = fmt.Sprintf("%s (retried w/ identity, no-auth was [%s])", meta, r.AuthRetryOf)
+	}
+	if r.Wildcard {
+		meta = fmt.Sprintf("%s (wildcard)", meta)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	fmt.Fprintf(o.w, "%-6s %-*s Size: %-6d %s\n",
+		o.bold(formatStatusCode(r.Status)(fmt.Sprintf("[%s]", r.Status))),
+		30, outputURL,
+		r.Size,
+		meta)
+}
+
+func (o *prettyOutput) Close() error {
+	if o.c != nil {
+		return o.c.Close()
+	}
+	return nil
+}
+
+// jsonlOutput writes one JSON object per result.
+type jsonlOutput struct {
+	mu sync.Mutex
+	w  io.Writer
+	c  io.Closer
+}
+
+func (o *jsonlOutput) Emit(r Result) {
+	rec := struct {
+		URL            string `json:"url"`
+		Status         string `json:"status"`
+		Meta           string `json:"meta"`
+		Size           int64  `json:"size"`
+		Depth          int    `json:"depth"`
+		RedirectTarget string `json:"redirect_target,omitempty"`
+		ElapsedMs      int64  `json:"elapsed_ms"`
+		TLSFingerprint string `json:"tls_fingerprint,omitempty"`
+		AuthRetryOf    string `json:"auth_retry_of,omitempty"`
+		Wildcard       bool   `json:"wildcard,omitempty"`
+	}{r.URL, r.Status, r.Meta, r.Size, r.Depth, r.RedirectTarget, r.ElapsedMs, r.TLSFingerprint, r.AuthRetryOf, r.Wildcard}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		slog.Debug("Failed to marshal result", "err", err)
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	fmt.Fprintln(o.w, string(b))
+}
+
+func (o *jsonlOutput) Close() error {
+	if o.c != nil {
+		return o.c.Close()
+	}
+	return nil
+}
+
+// csvOutput writes one row per result, with a header written on first use.
+type csvOutput struct {
+	mu          sync.Mutex
+	w           *csv.Writer
+	c           io.Closer
+	wroteHeader bool
+}
+
+var csvHeader = []string{"url", "status", "meta", "size", "depth", "redirect_target", "elapsed_ms", "tls_fingerprint", "auth_retry_of", "wildcard"}
+
+func (o *csvOutput) Emit(r Result) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !o.wroteHeader {
+		o.w.Write(csvHeader)
+		o.wroteHeader = true
+	}
+
+	o.w.Write([]string{
+		r.URL,
+		r.Status,
+		r.Meta,
+		strconv.FormatInt(r.Size, 10),
+		strconv.Itoa(r.Depth),
+		r.RedirectTarget,
+		strconv.FormatInt(r.ElapsedMs, 10),
+		r.TLSFingerprint,
+		r.AuthRetryOf,
+		strconv.FormatBool(r.Wildcard),
+	})
+	o.w.Flush()
+}
+
+func (o *csvOutput) Close() error {
+	if o.c != nil {
+		return o.c.Close()
+	}
+	return nil
+}
+
+// plainOutput is a gobuster-compatible single-line-per-hit format, meant for
+// piping into other tools.
+type plainOutput struct {
+	mu   sync.Mutex
+	w    io.Writer
+	c    io.Closer
+	mode string
+}
+
+func (o *plainOutput) Emit(r Result) {
+	u, _ := url.Parse(r.URL)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	fmt.Fprintf(o.w, "%-35s (Status: %s) [Size: %d]\n", formatOutput(u, o.mode), r.Status, r.Size)
+}
+
+func (o *plainOutput) Close() error {
+	if o.c != nil {
+		return o.c.Close()
+	}
+	return nil
+}
+
+// visitedSet tracks canonical URLs that have already been queued or fetched,
+// so recursion/spidering never re-enqueues the same URL twice.
+type visitedSet struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func newVisitedSet() *visitedSet {
+	return &visitedSet{seen: make(map[string]bool)}
+}
+
+// markNew records u as visited and reports whether it was new.
+func (v *visitedSet) markNew(u string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.seen[u] {
+		return false
+	}
+	v.seen[u] = true
+	return true
+}
+
+// extractLinks scans a text/gemini body for "=>" link lines and resolves
+// each target against pageURL, per the gemtext spec.
+func extractLinks(body []byte, pageURL *url.URL) []*url.URL {
+	var links []*url.URL
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "=>") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "=>"))
+		if len(fields) == 0 {
+			continue
+		}
+		target, err := url.Parse(fields[0])
+		if err != nil {
+			slog.Debug("Skipping unparsable link", "line", line, "err", err)
+			continue
+		}
+		links = append(links, pageURL.ResolveReference(target))
+	}
+	return links
+}
+
+// inScope reports whether u belongs to the same host as baseURL and sits
+// under baseURL's path, so spidering can't wander off the target capsule.
+func inScope(u *url.URL, baseURL *url.URL) bool {
+	if u.Hostname() != baseURL.Hostname() {
+		return false
+	}
+	if u.Path == baseURL.Path {
+		return true
+	}
+	return strings.HasPrefix(u.Path, strings.TrimSuffix(baseURL.Path, "/")+"/")
 }
 
 func main() {
@@ -318,11 +1000,29 @@ func main() {
 
 	fmt.Printf("Using base URL: %s\n\n", baseURL.String())
 
-	jobs := make(chan Job, len(wordlist))
-	done := make(chan struct{})
+	var tofu *TofuStore
+	if cfg.Tofu && !cfg.Insecure {
+		tofu, err = NewTofuStore(cfg.TofuFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading TOFU store: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	identity, err := loadIdentity(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading client identity: %v\n", err)
+		os.Exit(1)
+	}
+
+	output, err := newOutput(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting up output: %v\n", err)
+		os.Exit(1)
+	}
+	defer output.Close()
 
-	// Setup Output Formatting
-	bold := color.New(color.Bold).SprintFunc()
+	limiters := newLimiterRegistry(cfg.Rate)
 
 	var urlGen URLGen
 	switch cfg.Mode {
@@ -332,52 +1032,154 @@ func main() {
 		urlGen = vhostURLGen
 	}
 
+	var baseline *Baseline
+	if !cfg.NoWildcard {
+		baseline = probeBaseline(baseURL, cfg, tofu, urlGen, cfg.BaselineN)
+		if baseline != nil {
+			fmt.Printf("Detected wildcard response: [%s] Size: %d -- suppressing matching hits\n\n", baseline.Status, baseline.Size)
+		}
+	}
+
+	// jobs is an unbounded queue: workers both drain it and push newly
+	// discovered URLs back onto it. wg tracks outstanding jobs so we know
+	// when to close it.
+	jobs := newJobQueue()
+	var wg sync.WaitGroup
+	visited := newVisitedSet()
+
 	seedJobs := buildURLs(baseURL, wordlist, urlGen, cfg.Extensions)
+	for _, j := range seedJobs {
+		visited.markNew(j.URL)
+	}
+	wg.Add(len(seedJobs))
+	for _, j := range seedJobs {
+		jobs.Push(j)
+	}
+
 	go func() {
-		for _, j := range seedJobs {
-			jobs <- j
-		}
-		close(jobs)
+		wg.Wait()
+		jobs.Close()
 	}()
+
 	var workers int = cfg.Threads
 
 	doneWorkers := make(chan struct{}, workers)
 	for i := 0; i < workers; i++ {
 		go func() {
-			for job := range jobs {
-
-				u := job.URL
-				depth := job.Depth
-				status, meta, size, err := fetchGeminiOnce(u, baseURL, cfg.Timeout, cfg.Insecure)
-				if err != nil && cfg.Verbose {
-					fmt.Fprintf(os.Stderr, "Error fetching %s: %v\n", u, err)
+			for {
+				job, ok := jobs.Pop()
+				if !ok {
+					break
 				}
+				func() {
+					defer wg.Done()
 
-				if isWhitelisted(status, cfg.FilterCodes) && (int(size) != cfg.FilterSize) {
-					rawURL, _ := url.Parse(u)
-					var outputURL = formatOutput(rawURL, cfg.Mode)
+					u := job.URL
+					depth := job.Depth
 
-					// Redirect logic
-					if strings.HasPrefix(status, "3") {
-						redirURL, _ := url.Parse(meta)
-						outputURL = fmt.Sprintf("%s -> %s", formatOutput(rawURL, cfg.Mode), formatOutput(redirURL, cfg.Mode))
+					host := baseURL.Hostname()
+					if pu, perr := url.Parse(u); perr == nil {
+						host = pu.Hostname()
+					}
+					limiters.forHost(host).Wait()
+
+					start := time.Now()
+					status, meta, size, body, tlsFingerprint, bodyHash, err := fetchGeminiOnce(u, baseURL, cfg, tofu, nil)
+					var tofuErr *TofuError
+					if errors.As(err, &tofuErr) {
+						slog.Warn("TOFU verification failed, skipping", "url", u, "err", tofuErr)
+					} else if err != nil && cfg.Verbose {
+						fmt.Fprintf(os.Stderr, "Error fetching %s: %v\n", u, err)
 					}
 
-					// Print row to stdout with padding
-					fmt.Printf("%-6s %-*s Size: %-6d %s\n",
-						bold(formatStatusCode(status)(fmt.Sprintf("[%s]", status))),
-						30, outputURL,
-						size,
-						meta)
+					// Gemini's 44 SLOW_DOWN carries a retry-after in meta; back the
+					// host's limiter off and requeue the job rather than dropping it.
+					if status == "44" {
+						seconds, _ := strconv.Atoi(strings.TrimSpace(meta))
+						limiters.forHost(host).SlowDown(seconds)
+						if cfg.OutputAll {
+							output.Emit(Result{
+								URL:            u,
+								Status:         status,
+								Meta:           meta,
+								Size:           size,
+								Depth:          depth,
+								ElapsedMs:      time.Since(start).Milliseconds(),
+								TLSFingerprint: tlsFingerprint,
+							})
+						}
+						if job.Retries < cfg.MaxRetries {
+							slog.Info("Rate limited (44), requeuing", "url", u, "retry", job.Retries+1, "slow_down_seconds", seconds)
+							wg.Add(1)
+							jobs.Push(Job{URL: u, Depth: depth, Retries: job.Retries + 1})
+						} else {
+							slog.Warn("Dropping job after max retries", "url", u, "retries", job.Retries)
+						}
+						return
+					}
 
-					// If directory, recurse if not at max depth
-					if strings.HasPrefix(status, "2") && strings.HasSuffix(u, "/") && depth < cfg.Recursive {
-						// Enqueue new job
-						slog.Info("Hit new directory", "url", u, "depth", depth)
+					// Gemini gates identity-restricted paths behind a 6x status; retry
+					// once with our client certificate (if any) so a scan surfaces both
+					// which paths require auth and which reject our identity.
+					var authRetryOf string
+					if strings.HasPrefix(status, "6") && identity != nil {
+						initialStatus := status
+						limiters.forHost(host).Wait()
+						rStatus, rMeta, rSize, rBody, rFingerprint, rHash, rErr := fetchGeminiOnce(u, baseURL, cfg, tofu, identity)
+						if rErr == nil {
+							slog.Info("Retried with client identity", "url", u, "initial_status", initialStatus, "retry_status", rStatus)
+							status, meta, size, body, tlsFingerprint, bodyHash = rStatus, rMeta, rSize, rBody, rFingerprint, rHash
+							authRetryOf = initialStatus
+						} else if cfg.Verbose {
+							fmt.Fprintf(os.Stderr, "Error retrying %s with identity: %v\n", u, rErr)
+						}
+					}
 
-						// TODO: Decide where or not to add recursion. Will require job/queue rework
+					isWildcard := baseline != nil && baseline.Matches(status, size, bodyHash)
+					whitelisted := isWhitelisted(status, cfg.FilterCodes) && (int(size) != cfg.FilterSize) && !isWildcard
+					if whitelisted || cfg.OutputAll {
+						result := Result{
+							URL:            u,
+							Status:         status,
+							Meta:           meta,
+							Size:           size,
+							Depth:          depth,
+							ElapsedMs:      time.Since(start).Milliseconds(),
+							TLSFingerprint: tlsFingerprint,
+							AuthRetryOf:    authRetryOf,
+							Wildcard:       isWildcard,
+						}
+						if strings.HasPrefix(status, "3") {
+							result.RedirectTarget = meta
+						}
+						output.Emit(result)
 					}
-				}
+
+					// Recurse/spider: text/gemini hits carry a body to mine for links.
+					// With Spider off we only follow directory hits, matching the
+					// original dirbusting-only behavior; with it on we follow any hit.
+					if !isWildcard && strings.HasPrefix(status, "2") && strings.HasPrefix(meta, "text/gemini") &&
+						depth < cfg.Recursive && (cfg.Spider || strings.HasSuffix(u, "/")) {
+
+						rawURL, perr := url.Parse(u)
+						if perr != nil {
+							return
+						}
+
+						for _, link := range extractLinks(body, rawURL) {
+							if !inScope(link, baseURL) {
+								continue
+							}
+							target := link.String()
+							if !visited.markNew(target) {
+								continue
+							}
+							slog.Info("Discovered link", "url", target, "depth", depth+1)
+							wg.Add(1)
+							jobs.Push(Job{URL: target, Depth: depth + 1})
+						}
+					}
+				}()
 			}
 			doneWorkers <- struct{}{}
 		}()
@@ -387,5 +1189,4 @@ func main() {
 	for i := 0; i < workers; i++ {
 		<-doneWorkers
 	}
-	close(done)
 }